@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// loadCachedStatus reads a previously persisted MirrorStatus from path.
+// FetchedAt reflects when the data was originally fetched, not when it was
+// loaded from disk, so staleness checks stay meaningful across restarts.
+func loadCachedStatus(path string) (*MirrorStatus, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var m MirrorStatus
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, fmt.Errorf("parsing mirror cache: %w", err)
+	}
+
+	for _, mirror := range m.Global {
+		mirror.Health = &MirrorHealth{}
+	}
+	m.Countries, m.GlobalByProtocol = indexMirrors(m.Global)
+
+	return &m, nil
+}
+
+// saveCachedStatus persists m to path, writing to a temporary file first and
+// renaming it into place so a crash mid-write can't corrupt the last-known-
+// good cache.
+func saveCachedStatus(path string, m *MirrorStatus) error {
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// geoSelector returns a selector that resolves the client's country from its
+// address using db and redirects to the best mirror in that country,
+// falling back to the global best mirror when db is nil, the country has
+// no mirrors, or the lookup otherwise fails.
+func geoSelector(db *geoIPDB, cache *ipCountryCache, trustedProxies []*net.IPNet, protocols []string, lb *loadBalancer) selector {
+	fallback := globalSelector(protocols, lb)
+
+	return func(status *MirrorStatus, r *http.Request) (*Mirror, error) {
+		if db == nil {
+			return fallback(status, r)
+		}
+
+		ip := clientIP(r, trustedProxies)
+		if ip == nil {
+			return fallback(status, r)
+		}
+
+		country, ok := cache.lookup(ip)
+		if !ok {
+			resolved, err := db.lookupCountry(ip)
+			if err != nil {
+				return fallback(status, r)
+			}
+			country = resolved
+			cache.store(ip, country)
+		}
+
+		if country == "" {
+			return fallback(status, r)
+		}
+
+		byProtocol, ok := status.Countries[country]
+		if !ok {
+			return fallback(status, r)
+		}
+
+		for _, proto := range protocols {
+			if list := filterHealthy(byProtocol[proto]); len(list) > 0 {
+				return lb.pick(list, "auto:"+country+":"+proto)
+			}
+		}
+
+		return fallback(status, r)
+	}
+}
+
+// clientIP determines the address to use for GeoIP lookup: the direct peer
+// address, unless it is a trusted proxy, in which case X-Forwarded-For (the
+// first hop) or X-Real-IP is preferred.
+func clientIP(r *http.Request, trustedProxies []*net.IPNet) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	peer := net.ParseIP(host)
+	if peer == nil {
+		return nil
+	}
+
+	if !ipInAny(peer, trustedProxies) {
+		return peer
+	}
+
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		first := strings.TrimSpace(strings.SplitN(xff, ",", 2)[0])
+		if ip := net.ParseIP(first); ip != nil {
+			return ip
+		}
+	}
+
+	if xri := strings.TrimSpace(r.Header.Get("X-Real-IP")); xri != "" {
+		if ip := net.ParseIP(xri); ip != nil {
+			return ip
+		}
+	}
+
+	return peer
+}
+
+func ipInAny(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipCountryCache is an LRU cache of IP-prefix to country-code lookups,
+// bounding memory by collapsing addresses to their containing /24 (IPv4) or
+// /48 (IPv6) prefix.
+type ipCountryCache struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+type ipCountryCacheEntry struct {
+	key     string
+	country string
+}
+
+func newIPCountryCache(capacity int) *ipCountryCache {
+	return &ipCountryCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func ipCachePrefix(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+func (c *ipCountryCache) lookup(ip net.IP) (string, bool) {
+	key := ipCachePrefix(ip)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return "", false
+	}
+
+	c.ll.MoveToFront(el)
+	return el.Value.(*ipCountryCacheEntry).country, true
+}
+
+func (c *ipCountryCache) store(ip net.IP, country string) {
+	key := ipCachePrefix(ip)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		el.Value.(*ipCountryCacheEntry).country = country
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	el := c.ll.PushFront(&ipCountryCacheEntry{key: key, country: country})
+	c.items[key] = el
+
+	if c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		if oldest != nil {
+			c.ll.Remove(oldest)
+			delete(c.items, oldest.Value.(*ipCountryCacheEntry).key)
+		}
+	}
+}
+
+// geoIPDB is a minimal reader for the MaxMind DB (.mmdb) binary format. It
+// implements just enough of the spec (https://maxmind.github.io/MaxMind-DB/)
+// to walk the binary search tree and decode a GeoLite2-Country record; it
+// does not support writing or the full range of data types in the spec.
+type geoIPDB struct {
+	tree        []byte
+	dataSection []byte
+	nodeCount   int
+	recordSize  int
+	ipVersion   int
+}
+
+const mmdbMetadataMarker = "\xab\xcd\xefMaxMind.com"
+
+func openGeoIPDB(path string) (*geoIPDB, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	markerIdx := strings.LastIndex(string(raw), mmdbMetadataMarker)
+	if markerIdx < 0 {
+		return nil, fmt.Errorf("geoip: %q is not a MaxMind DB (metadata marker not found)", path)
+	}
+
+	metaSection := raw[markerIdx+len(mmdbMetadataMarker):]
+	meta, _, err := decodeMMDBValue(metaSection, 0, metaSection)
+	if err != nil {
+		return nil, fmt.Errorf("geoip: decoding metadata: %w", err)
+	}
+
+	metaMap, ok := meta.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("geoip: metadata section is not a map")
+	}
+
+	nodeCount, ok1 := mmdbInt(metaMap["node_count"])
+	recordSize, ok2 := mmdbInt(metaMap["record_size"])
+	ipVersion, ok3 := mmdbInt(metaMap["ip_version"])
+	if !ok1 || !ok2 || !ok3 || nodeCount == 0 || recordSize == 0 {
+		return nil, errors.New("geoip: missing node_count/record_size/ip_version in metadata")
+	}
+
+	treeSize := nodeCount * recordSize * 2 / 8
+	// the search tree is followed by a 16-byte all-zero separator, then the
+	// data section, then the metadata we already located above.
+	if treeSize+16 > markerIdx {
+		return nil, errors.New("geoip: search tree overruns metadata section")
+	}
+
+	return &geoIPDB{
+		tree:        raw[:treeSize],
+		dataSection: raw[treeSize+16 : markerIdx],
+		nodeCount:   nodeCount,
+		recordSize:  recordSize,
+		ipVersion:   ipVersion,
+	}, nil
+}
+
+// lookupCountry resolves ip to a GeoLite2-Country ISO code. It returns an
+// empty string (not an error) when the address is simply absent from the
+// database.
+func (db *geoIPDB) lookupCountry(ip net.IP) (string, error) {
+	bits := mmdbAddressBits(ip, db.ipVersion)
+	if bits == nil {
+		return "", fmt.Errorf("geoip: address %s is not compatible with this database", ip)
+	}
+
+	node := 0
+	for _, bit := range bits {
+		if node >= db.nodeCount {
+			break
+		}
+
+		left, right, err := db.readNode(node)
+		if err != nil {
+			return "", err
+		}
+
+		if bit == 0 {
+			node = left
+		} else {
+			node = right
+		}
+	}
+
+	if node == db.nodeCount {
+		return "", nil
+	}
+	if node < db.nodeCount {
+		return "", errors.New("geoip: lookup terminated inside the search tree")
+	}
+
+	dataOffset := node - db.nodeCount - 16
+	if dataOffset < 0 || dataOffset >= len(db.dataSection) {
+		return "", errors.New("geoip: data pointer out of range")
+	}
+
+	val, _, err := decodeMMDBValue(db.dataSection, dataOffset, db.dataSection)
+	if err != nil {
+		return "", err
+	}
+
+	record, ok := val.(map[string]interface{})
+	if !ok {
+		return "", errors.New("geoip: unexpected record shape")
+	}
+
+	country, ok := record["country"].(map[string]interface{})
+	if !ok {
+		country, _ = record["registered_country"].(map[string]interface{})
+	}
+	if country == nil {
+		return "", nil
+	}
+
+	iso, _ := country["iso_code"].(string)
+	return iso, nil
+}
+
+func (db *geoIPDB) readNode(nodeIndex int) (left, right int, err error) {
+	nodeBytes := db.recordSize * 2 / 8
+	offset := nodeIndex * nodeBytes
+	if offset+nodeBytes > len(db.tree) {
+		return 0, 0, errors.New("geoip: node index out of range")
+	}
+
+	buf := db.tree[offset : offset+nodeBytes]
+
+	switch db.recordSize {
+	case 24:
+		left = int(buf[0])<<16 | int(buf[1])<<8 | int(buf[2])
+		right = int(buf[3])<<16 | int(buf[4])<<8 | int(buf[5])
+	case 28:
+		middle := buf[3]
+		left = int(buf[0])<<16 | int(buf[1])<<8 | int(buf[2]) | int(middle&0xF0)<<20
+		right = int(buf[4])<<16 | int(buf[5])<<8 | int(buf[6]) | int(middle&0x0F)<<24
+	case 32:
+		left = int(buf[0])<<24 | int(buf[1])<<16 | int(buf[2])<<8 | int(buf[3])
+		right = int(buf[4])<<24 | int(buf[5])<<16 | int(buf[6])<<8 | int(buf[7])
+	default:
+		return 0, 0, fmt.Errorf("geoip: unsupported record size %d", db.recordSize)
+	}
+
+	return left, right, nil
+}
+
+// mmdbAddressBits returns ip as a slice of individual bits (MSB first) in
+// the address space of the database (dbIPVersion). IPv4 addresses looked up
+// against an IPv6 database are mapped to the ::/96 prefix per the spec.
+func mmdbAddressBits(ip net.IP, dbIPVersion int) []byte {
+	if v4 := ip.To4(); v4 != nil {
+		if dbIPVersion == 6 {
+			full := make([]byte, 16)
+			copy(full[12:], v4)
+			return mmdbBytesToBits(full)
+		}
+		return mmdbBytesToBits(v4)
+	}
+
+	if v6 := ip.To16(); v6 != nil && dbIPVersion == 6 {
+		return mmdbBytesToBits(v6)
+	}
+
+	return nil
+}
+
+func mmdbBytesToBits(b []byte) []byte {
+	bits := make([]byte, 0, len(b)*8)
+	for _, by := range b {
+		for i := 7; i >= 0; i-- {
+			bits = append(bits, (by>>uint(i))&1)
+		}
+	}
+	return bits
+}
+
+// decodeMMDBValue decodes a single MaxMind DB data-section value starting
+// at offset within data, resolving any pointers relative to base (the whole
+// data section). It returns the decoded value and the offset of the byte
+// immediately following the value within data.
+func decodeMMDBValue(data []byte, offset int, base []byte) (interface{}, int, error) {
+	if offset < 0 || offset >= len(data) {
+		return nil, offset, errors.New("geoip: offset out of range")
+	}
+
+	ctrl := data[offset]
+	offset++
+
+	typeNum := int(ctrl >> 5)
+	if typeNum == 0 {
+		if offset >= len(data) {
+			return nil, offset, errors.New("geoip: truncated extended type")
+		}
+		typeNum = int(data[offset]) + 7
+		offset++
+	}
+
+	if typeNum == 1 {
+		return decodeMMDBPointer(data, offset, ctrl, base)
+	}
+
+	size := int(ctrl & 0x1F)
+	switch {
+	case size == 29:
+		size = 29 + int(data[offset])
+		offset++
+	case size == 30:
+		size = 285 + int(data[offset])<<8 + int(data[offset+1])
+		offset += 2
+	case size == 31:
+		size = 65821 + int(data[offset])<<16 + int(data[offset+1])<<8 + int(data[offset+2])
+		offset += 3
+	}
+
+	if typeNum != 14 && offset+size > len(data) {
+		return nil, offset, errors.New("geoip: value overruns data section")
+	}
+
+	switch typeNum {
+	case 2: // string
+		return string(data[offset : offset+size]), offset + size, nil
+	case 3: // double
+		if size != 8 {
+			return nil, offset + size, fmt.Errorf("geoip: double has size %d, want 8", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(data[offset : offset+8])), offset + size, nil
+	case 4: // bytes
+		return append([]byte(nil), data[offset:offset+size]...), offset + size, nil
+	case 5, 6, 9, 10: // uint16, uint32, uint64, uint128 (128 truncated to 64 bits - unused by country lookups)
+		return mmdbDecodeUint(data[offset : offset+size]), offset + size, nil
+	case 7: // map
+		m := make(map[string]interface{}, size)
+		next := offset
+		for i := 0; i < size; i++ {
+			var key, val interface{}
+			var err error
+			if key, next, err = decodeMMDBValue(data, next, base); err != nil {
+				return nil, next, err
+			}
+			if val, next, err = decodeMMDBValue(data, next, base); err != nil {
+				return nil, next, err
+			}
+			if ks, ok := key.(string); ok {
+				m[ks] = val
+			}
+		}
+		return m, next, nil
+	case 8: // int32
+		return int32(mmdbDecodeUint(data[offset : offset+size])), offset + size, nil
+	case 11: // array
+		arr := make([]interface{}, 0, size)
+		next := offset
+		for i := 0; i < size; i++ {
+			var val interface{}
+			var err error
+			if val, next, err = decodeMMDBValue(data, next, base); err != nil {
+				return nil, next, err
+			}
+			arr = append(arr, val)
+		}
+		return arr, next, nil
+	case 14: // boolean: the "size" field is the value itself, no payload bytes
+		return size != 0, offset, nil
+	case 15: // float
+		if size != 4 {
+			return nil, offset + size, fmt.Errorf("geoip: float has size %d, want 4", size)
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(data[offset : offset+4])), offset + size, nil
+	default:
+		return nil, offset + size, fmt.Errorf("geoip: unsupported data type %d", typeNum)
+	}
+}
+
+func decodeMMDBPointer(data []byte, offset int, ctrl byte, base []byte) (interface{}, int, error) {
+	sizeClass := (ctrl >> 3) & 0x3
+
+	consumed := int(sizeClass) + 1
+	if offset+consumed > len(data) {
+		return nil, offset + consumed, errors.New("geoip: truncated pointer")
+	}
+
+	var pointerValue int
+	switch sizeClass {
+	case 0:
+		pointerValue = int(ctrl&0x7)<<8 | int(data[offset])
+	case 1:
+		pointerValue = int(ctrl&0x7)<<16 | int(data[offset])<<8 | int(data[offset+1])
+		pointerValue += 2048
+	case 2:
+		pointerValue = int(ctrl&0x7)<<24 | int(data[offset])<<16 | int(data[offset+1])<<8 | int(data[offset+2])
+		pointerValue += 526336
+	default:
+		pointerValue = int(data[offset])<<24 | int(data[offset+1])<<16 | int(data[offset+2])<<8 | int(data[offset+3])
+	}
+
+	val, _, err := decodeMMDBValue(base, pointerValue, base)
+	if err != nil {
+		return nil, offset + consumed, err
+	}
+
+	return val, offset + consumed, nil
+}
+
+func mmdbDecodeUint(b []byte) uint64 {
+	var v uint64
+	for _, by := range b {
+		v = v<<8 | uint64(by)
+	}
+	return v
+}
+
+func mmdbInt(v interface{}) (int, bool) {
+	switch n := v.(type) {
+	case uint64:
+		return int(n), true
+	case int32:
+		return int(n), true
+	}
+	return 0, false
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDecodeMMDBValueString(t *testing.T) {
+	data := append([]byte{0x45}, "hello"...) // ctrl: type=2 (string), size=5
+
+	val, next, err := decodeMMDBValue(data, 0, data)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if val != "hello" {
+		t.Errorf("got %v, want %q", val, "hello")
+	}
+	if next != len(data) {
+		t.Errorf("next = %d, want %d", next, len(data))
+	}
+}
+
+func TestDecodeMMDBValueDouble(t *testing.T) {
+	want := 3.14159
+	bits := math.Float64bits(want)
+	data := []byte{0x68} // ctrl: type=3 (double), size=8
+	for i := 7; i >= 0; i-- {
+		data = append(data, byte(bits>>(8*i)))
+	}
+
+	val, _, err := decodeMMDBValue(data, 0, data)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if val != want {
+		t.Errorf("got %v, want %v", val, want)
+	}
+}
+
+func TestDecodeMMDBValueDoubleBadSize(t *testing.T) {
+	// ctrl claims type=3 (double) with size=3, which the double case must
+	// reject rather than slicing 8 bytes out of a 3-byte payload.
+	data := []byte{0x63, 0x01, 0x02, 0x03}
+
+	if _, _, err := decodeMMDBValue(data, 0, data); err == nil {
+		t.Fatal("expected an error for a malformed double size, got nil")
+	}
+}
+
+func TestDecodeMMDBValueFloat(t *testing.T) {
+	want := float32(2.5)
+	bits := math.Float32bits(want)
+	data := []byte{0x04, 0x08} // ctrl: extended type, size=4; extended type byte 8 -> typeNum 15 (float)
+	for i := 3; i >= 0; i-- {
+		data = append(data, byte(bits>>(8*i)))
+	}
+
+	val, _, err := decodeMMDBValue(data, 0, data)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if val != want {
+		t.Errorf("got %v, want %v", val, want)
+	}
+}
+
+func TestDecodeMMDBValueFloatBadSize(t *testing.T) {
+	// size=1 instead of the required 4.
+	data := []byte{0x01, 0x08, 0xff}
+
+	if _, _, err := decodeMMDBValue(data, 0, data); err == nil {
+		t.Fatal("expected an error for a malformed float size, got nil")
+	}
+}
+
+func TestDecodeMMDBValueMap(t *testing.T) {
+	// {"iso_code": "US"}
+	data := []byte{0xe1} // ctrl: type=7 (map), size=1
+	data = append(data, 0x48)
+	data = append(data, "iso_code"...)
+	data = append(data, 0x42)
+	data = append(data, "US"...)
+
+	val, _, err := decodeMMDBValue(data, 0, data)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	m, ok := val.(map[string]interface{})
+	if !ok {
+		t.Fatalf("got %T, want map[string]interface{}", val)
+	}
+	if m["iso_code"] != "US" {
+		t.Errorf("iso_code = %v, want US", m["iso_code"])
+	}
+}
+
+func TestDecodeMMDBValueTruncatedPointer(t *testing.T) {
+	// ctrl: type=1 (pointer), size class 3 (4-byte pointer), but no
+	// follow-on bytes at all.
+	data := []byte{0x38}
+
+	if _, _, err := decodeMMDBValue(data, 0, data); err == nil {
+		t.Fatal("expected an error for a truncated pointer, got nil")
+	}
+}
+
+func TestDecodeMMDBValueOffsetOutOfRange(t *testing.T) {
+	data := []byte{0x45, 'h'}
+
+	if _, _, err := decodeMMDBValue(data, 10, data); err == nil {
+		t.Fatal("expected an error for an out-of-range offset, got nil")
+	}
+}
+
+func TestReadNode(t *testing.T) {
+	db := &geoIPDB{
+		recordSize: 24,
+		tree:       []byte{0x00, 0x00, 0x01, 0x00, 0x00, 0x02},
+	}
+
+	left, right, err := db.readNode(0)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if left != 1 || right != 2 {
+		t.Errorf("got left=%d right=%d, want left=1 right=2", left, right)
+	}
+}
+
+func TestReadNodeOutOfRange(t *testing.T) {
+	db := &geoIPDB{
+		recordSize: 24,
+		tree:       []byte{0x00, 0x00, 0x01, 0x00, 0x00, 0x02},
+	}
+
+	if _, _, err := db.readNode(1); err == nil {
+		t.Fatal("expected an error for a node index past the end of the tree, got nil")
+	}
+}
+
+func TestReadNodeUnsupportedRecordSize(t *testing.T) {
+	db := &geoIPDB{
+		recordSize: 16,
+		tree:       []byte{0x00, 0x00, 0x00, 0x00},
+	}
+
+	if _, _, err := db.readNode(0); err == nil {
+		t.Fatal("expected an error for an unsupported record size, got nil")
+	}
+}
@@ -1,24 +1,37 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
 	"path"
 	"regexp"
 	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 var conf config
 
+// protocolsFlag and protocolCompletionFlag hold the raw comma-separated flag
+// values; they are parsed into conf.protocols / conf.protocolMinCompletion
+// once flag.Parse has run.
+var protocolsFlag string
+var protocolCompletionFlag string
+var trustProxyFlag string
+
 type selector func(*MirrorStatus, *http.Request) (*Mirror, error)
 
 // config represents the application configuration
@@ -28,6 +41,23 @@ type config struct {
 	minCompletion float64
 	host          string
 	port          int
+	probe         probeConfig
+
+	// protocols is the allowlist of mirror protocols to serve, in
+	// preference order. A mirror whose protocol is not present is dropped
+	// entirely during filtering.
+	protocols []string
+	// protocolMinCompletion holds per-protocol completion overrides; a
+	// protocol absent from this map falls back to minCompletion.
+	protocolMinCompletion map[string]float64
+
+	geoipPath  string
+	trustProxy []*net.IPNet
+
+	lb lbConfig
+
+	cachePath string
+	maxStale  time.Duration
 }
 
 // Mirror is a description of an Arch Linux Mirror
@@ -42,6 +72,15 @@ type Mirror struct {
 	CountryCode string     `json:"country_code"`
 	DurStdDev   float64    `json:"duration_stddev"`
 	DurAvg      float64    `json:"duration_avg"`
+
+	// Health holds rolling metrics gathered by the active probe subsystem.
+	// It is not part of the upstream payload and is populated after decode.
+	Health *MirrorHealth `json:"-"`
+
+	// Inflight counts outstanding redirects handed out to this mirror, for
+	// the least_inflight load-balancing policy. Decremented on a TTL by
+	// the loadBalancer rather than on confirmed completion.
+	Inflight atomic.Int64 `json:"-"`
 }
 
 // MirrorStatus is global status information for mirror checks
@@ -52,7 +91,24 @@ type MirrorStatus struct {
 	LastCheck      time.Time `json:"last_check"`
 	Version        int       `json:"version"`
 	Global         []*Mirror `json:"urls"`
-	Countries      map[string][]*Mirror
+
+	// FetchedAt is when kaleidoscope itself retrieved this data, not part
+	// of the upstream payload. It backs the -cache/-max-stale staleness
+	// checks and the /status endpoint's age reporting.
+	FetchedAt time.Time `json:"fetched_at"`
+
+	// Countries indexes filtered mirrors by country code and then by
+	// protocol, so a selector can fall back across protocols when the
+	// preferred one has no mirrors in a given country. Not serialized: it
+	// holds the same *Mirror pointers as Global, and round-tripping it
+	// through JSON would give each index its own copies instead, breaking
+	// pointer identity with the Global entries that probes/lb update.
+	Countries map[string]map[string][]*Mirror `json:"-"`
+
+	// GlobalByProtocol indexes filtered mirrors by protocol only, each
+	// slice retaining the score ordering of Global. Not serialized for the
+	// same reason as Countries.
+	GlobalByProtocol map[string][]*Mirror `json:"-"`
 }
 
 // ByScore implements sort.Interface for []*Mirror based on the Score field.
@@ -68,157 +124,455 @@ func init() {
 	flag.Float64Var(&conf.minCompletion, "completion", 1.0, "minimum mirror completion threshold")
 	flag.StringVar(&conf.host, "host", "0.0.0.0", "host to listen for connections on")
 	flag.IntVar(&conf.port, "port", 9090, "port to listen for on")
+
+	flag.StringVar(&protocolsFlag, "protocols", "https,http", "comma-separated allowlist of mirror protocols to serve, in preference order")
+	flag.StringVar(&protocolCompletionFlag, "protocol-completion", "", "comma-separated per-protocol completion overrides, e.g. rsync=0.95,http=1.0")
+
+	flag.BoolVar(&conf.probe.enabled, "probe", false, "actively probe mirrors for latency/throughput")
+	flag.DurationVar(&conf.probe.interval, "probe-interval", 5*time.Minute, "interval between probe rounds")
+	flag.DurationVar(&conf.probe.timeout, "probe-timeout", 10*time.Second, "per-mirror probe timeout")
+	flag.IntVar(&conf.probe.concurrency, "probe-concurrency", 8, "maximum number of mirrors probed concurrently")
+	flag.StringVar(&conf.probe.path, "probe-path", "lastupdate", "path probed on each mirror to measure latency/throughput")
+	flag.IntVar(&conf.probe.maxFailures, "probe-max-failures", 5, "consecutive probe failures before a mirror is evicted")
+
+	flag.StringVar(&conf.geoipPath, "geoip", "", "path to a GeoLite2-Country MaxMind DB; enables /auto/")
+	flag.StringVar(&trustProxyFlag, "trust-proxy", "", "comma-separated CIDRs of peers trusted to set X-Forwarded-For/X-Real-IP")
+
+	flag.StringVar(&conf.lb.policy, "lb", "first", "load balancing policy across the top-N mirrors: first, round_robin, weighted_random, least_inflight")
+	flag.IntVar(&conf.lb.topN, "lb-top-n", 3, "number of top-scoring mirrors eligible for load balancing")
+	flag.DurationVar(&conf.lb.inflightTTL, "lb-inflight-ttl", 30*time.Second, "time after which an in-flight redirect is assumed complete for least_inflight accounting")
+
+	flag.StringVar(&conf.cachePath, "cache", "", "path to persist the last-known-good mirror list, loaded on startup so the listener doesn't wait on the first live fetch")
+	flag.DurationVar(&conf.maxStale, "max-stale", 0, "refuse to serve (503) mirror data older than this; 0 disables the check")
 }
 
 func main() {
 	// parse the command line flags
 	flag.Parse()
 
+	conf.protocols = parseProtocolList(protocolsFlag)
+	conf.protocolMinCompletion = parseProtocolCompletion(protocolCompletionFlag)
+	conf.trustProxy = parseTrustedProxies(trustProxyFlag)
+
 	log.Print("Starting...")
 
+	var geoDB *geoIPDB
+	if conf.geoipPath != "" {
+		db, err := openGeoIPDB(conf.geoipPath)
+		if err != nil {
+			log.Printf("GeoIP disabled: %s", err)
+		} else {
+			geoDB = db
+			log.Printf("GeoIP enabled using '%s'.", conf.geoipPath)
+		}
+	}
+	geoCache := newIPCountryCache(4096)
+
+	lb := newLoadBalancer(conf.lb)
+
 	// we want atomic writes to the global mirror status data
 	var status atomic.Value
-	done := make(chan bool)
+	// buffered so the updater's first-success signal never blocks, whether
+	// or not main ends up waiting on it
+	done := make(chan bool, 1)
+
+	if conf.cachePath != "" {
+		if cached, err := loadCachedStatus(conf.cachePath); err != nil {
+			log.Printf("Not using mirror cache at '%s': %s", conf.cachePath, err)
+		} else {
+			status.Store(cached)
+			log.Printf("Loaded cached mirror list from '%s' (age %s).", conf.cachePath, time.Since(cached.FetchedAt).Round(time.Second))
+		}
+	}
+
+	// ctx is cancelled on SIGINT/SIGTERM so the updater and probe loops
+	// shut down cleanly instead of being killed mid-fetch.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	// run the autoupdater forever
-	go update(&status, &conf, done)
+	go update(ctx, &status, &conf, done)
+
+	// run the active health-probe subsystem, if enabled
+	go runProbes(ctx, &status, conf.probe)
 
 	// handle the endpoints
 	mux := http.NewServeMux()
 
-	countryHandler := http.StripPrefix("/country", redirector(&status, countrySelector()))
-	globalHandler := http.StripPrefix("/global", redirector(&status, globalSelector))
-	mux.HandleFunc("/country/", countryHandler.(http.HandlerFunc))
-	mux.HandleFunc("/global/", globalHandler.(http.HandlerFunc))
+	countryHandler := http.StripPrefix("/country", redirector(&status, countrySelector(conf.protocols, lb), "country", metrics))
+	globalHandler := http.StripPrefix("/global", redirector(&status, globalSelector(conf.protocols, lb), "global", metrics))
+	bestHandler := http.StripPrefix("/best", redirector(&status, probeWeightedSelector, "best", metrics))
+	mux.HandleFunc("/country/", staleGate(&status, conf.maxStale, countryHandler))
+	mux.HandleFunc("/global/", staleGate(&status, conf.maxStale, globalHandler))
+	autoHandler := http.StripPrefix("/auto", redirector(&status, geoSelector(geoDB, geoCache, conf.trustProxy, conf.protocols, lb), "auto", metrics))
+	mux.HandleFunc("/best/", staleGate(&status, conf.maxStale, bestHandler))
+	mux.HandleFunc("/auto/", staleGate(&status, conf.maxStale, autoHandler))
+	mux.HandleFunc("/status", statusHandler(&status, conf.maxStale))
+	mux.HandleFunc("/metrics", metricsHandler(&status, metrics))
+
+	// mount a forced-protocol variant of /country and /global per
+	// configured protocol, e.g. /https/global/... or /rsync/country/...
+	for _, proto := range conf.protocols {
+		only := []string{proto}
+		countryPrefix, globalPrefix := "/"+proto+"/country", "/"+proto+"/global"
+		countryOnly := http.StripPrefix(countryPrefix, redirector(&status, countrySelector(only, lb), "country:"+proto, metrics))
+		globalOnly := http.StripPrefix(globalPrefix, redirector(&status, globalSelector(only, lb), "global:"+proto, metrics))
+		mux.HandleFunc(countryPrefix+"/", staleGate(&status, conf.maxStale, countryOnly))
+		mux.HandleFunc(globalPrefix+"/", staleGate(&status, conf.maxStale, globalOnly))
+	}
 
 	addr := fmt.Sprintf("%s:%d", conf.host, conf.port)
 
-	// serve forever
-	<-done
+	// if we already have last-known-good data from the cache, start
+	// serving immediately; otherwise wait for the first live fetch
+	if status.Load() == nil {
+		<-done
+	} else {
+		log.Print("Serving cached mirror data immediately; live update is running in the background.")
+	}
+
 	log.Printf("Init finished. Listening on %s", addr)
 	http.ListenAndServe(addr, mux)
 }
 
-// update performs a mirror status update whenever the ticker ticks, i.e.
-// once per configured interval.
-func update(status *atomic.Value, c *config, done chan<- bool) {
+// staleGate refuses requests with 503 when the currently loaded mirror data
+// is older than maxStale, so operators get a clear "kaleidoscope is
+// degraded" signal instead of silently serving stale mirrors. A zero
+// maxStale disables the check.
+func staleGate(status *atomic.Value, maxStale time.Duration, next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if maxStale > 0 {
+			if c, ok := status.Load().(*MirrorStatus); ok && c != nil && !c.FetchedAt.IsZero() {
+				if age := time.Since(c.FetchedAt); age > maxStale {
+					msg := fmt.Sprintf("kaleidoscope is degraded: mirror data is %s old (max %s)", age.Round(time.Second), maxStale)
+					http.Error(w, msg, http.StatusServiceUnavailable)
+					return
+				}
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// fetchBackoffBase is the starting wait after a failed fetch; it doubles on
+// each consecutive failure up to the configured interval.
+const fetchBackoffBase = 30 * time.Second
+
+// fetchBackoffJitter is the +/- fraction of jitter applied to each backoff
+// wait, so a fleet of kaleidoscope instances doesn't retry in lockstep.
+const fetchBackoffJitter = 0.2
+
+// backoff computes exponential backoff with jitter, capped at max.
+type backoff struct {
+	max     time.Duration
+	attempt int
+}
+
+func (b *backoff) next() time.Duration {
+	wait := fetchBackoffBase << uint(b.attempt)
+	if wait <= 0 || wait > b.max {
+		wait = b.max
+	}
+	if b.attempt < 30 {
+		b.attempt++
+	}
+
+	jittered := time.Duration(float64(wait) * (1 - fetchBackoffJitter + rand.Float64()*2*fetchBackoffJitter))
+	if jittered > b.max {
+		jittered = b.max
+	}
+	return jittered
+}
+
+func (b *backoff) reset() {
+	b.attempt = 0
+}
+
+// update fetches the mirror list once per configured interval, storing the
+// result whenever upstream answers with anything but 304 Not Modified (the
+// new list is not compared with the loaded one). On failure it backs off
+// exponentially (with jitter) rather than hammering the upstream URL, and a
+// SIGHUP forces an immediate out-of-cycle refresh. It returns when ctx is
+// cancelled.
+func update(ctx context.Context, status *atomic.Value, c *config, done chan<- bool) {
 	log.Printf("Auto updater started (interval %s).", c.interval)
-	ticker := time.NewTicker(c.interval)
+
 	var once sync.Once
-	// perform an update operation once per tick forever
+	signalReady := func() {
+		once.Do(func() {
+			done <- true
+			close(done)
+		})
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	bo := &backoff{max: c.interval}
+	var lastModified, etag string
+
+	// fetch immediately on startup, then once per c.interval thereafter
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
 	for {
+		select {
+		case <-ctx.Done():
+			log.Print("Auto updater shutting down.")
+			return
+		case <-hup:
+			log.Print("Received SIGHUP, forcing an immediate mirror refresh.")
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(0)
+			continue
+		case <-timer.C:
+		}
+
 		log.Print("Performing auto update...")
-		newM, err := getMirrorInfo(c)
-		// we might recover next tick, so log the error and move on.
+		start := time.Now()
+		prev, _ := status.Load().(*MirrorStatus)
+		newM, modified, newLastModified, newETag, err := getMirrorInfo(ctx, c, prev, lastModified, etag)
+		duration := time.Since(start)
+
 		if err != nil {
+			metrics.recordFetchFailure(duration, fetchErrorType(err))
 			log.Print(err)
+			wait := bo.next()
+			log.Printf("Retrying in %s.", wait)
+			timer.Reset(wait)
 			continue
 		}
-		// store the new configuration in a globally atomic operation
-		status.Store(newM)
-		log.Print("Auto update complete.")
-		once.Do(func() {
-			done <- true
-			close(done)
-		})
-		<-ticker.C
+
+		bo.reset()
+		metrics.recordFetchSuccess(duration)
+		lastModified, etag = newLastModified, newETag
+
+		if modified {
+			status.Store(newM)
+			if c.cachePath != "" {
+				if err := saveCachedStatus(c.cachePath, newM); err != nil {
+					log.Printf("Failed to persist mirror cache to '%s': %s", c.cachePath, err)
+				}
+			}
+			log.Print("Auto update complete.")
+		} else {
+			log.Print("Mirror list unchanged since last fetch.")
+		}
+
+		signalReady()
+		timer.Reset(c.interval)
 	}
 }
 
+// fetchErrorType classifies a getMirrorInfo error for the fetch_failures_total
+// metric's error_type label.
+func fetchErrorType(err error) string {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return "network"
+	}
+
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return "decode"
+	}
+
+	return "other"
+}
+
 // getMirrorInfo downloads and parses the mirror data from the configured URL.
-// It also filters mirrors for completion percentage and HTTP protocol.
-func getMirrorInfo(c *config) (*MirrorStatus, error) {
+// It also filters mirrors for completion percentage and allowed protocol.
+// getMirrorInfo downloads and filters the mirror list from c.url. If
+// lastModified/etag are non-empty, they're sent as conditional-GET
+// validators; a 304 response short-circuits decoding entirely and returns
+// modified=false. The validators seen on this response (possibly unchanged)
+// are always returned so the caller can pass them back in on the next call.
+// prev, if non-nil, is the previously loaded MirrorStatus; each mirror's
+// Health is carried forward from it (matched by URL) instead of being
+// reset, so the probe subsystem's rolling metrics survive a live refresh.
+func getMirrorInfo(ctx context.Context, c *config, prev *MirrorStatus, lastModified, etag string) (m *MirrorStatus, modified bool, newLastModified, newETag string, err error) {
 	log.Printf("Downloading mirror list from '%s'...", c.url)
-	resp, err := http.Get(c.url)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
 	if err != nil {
-		return nil, err
+		return nil, false, lastModified, etag, err
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, false, lastModified, etag, err
 	}
 	defer resp.Body.Close()
 
-	var m MirrorStatus
+	if resp.StatusCode == http.StatusNotModified {
+		log.Print("Mirror list not modified, skipping decode.")
+		return nil, false, lastModified, etag, nil
+	}
+
+	newLastModified, newETag = resp.Header.Get("Last-Modified"), resp.Header.Get("ETag")
+
+	var mm MirrorStatus
 
 	// unmarshal the retrieved JSON data
 	decoder := json.NewDecoder(resp.Body)
-	err = decoder.Decode(&m)
-	if err != nil {
-		return nil, err
+	if err := decoder.Decode(&mm); err != nil {
+		return nil, false, newLastModified, newETag, err
 	}
 
 	// nice reporting statistics
 
-	log.Printf("Filtering mirrors with HTTP and completion>=%f...", c.minCompletion)
-	totalCount, httpCount, completeCount := len(m.Global), 0, 0
+	log.Printf("Filtering mirrors with protocols=%v and completion>=%f (overrides=%v)...", c.protocols, c.minCompletion, c.protocolMinCompletion)
+	totalCount := len(mm.Global)
 	newMirrors := make([]*Mirror, 0, totalCount)
-	m.Countries = make(map[string][]*Mirror)
 
-	sort.Stable(sort.Reverse(ByScore(m.Global)))
+	allowed := make(map[string]bool, len(c.protocols))
+	for _, proto := range c.protocols {
+		allowed[proto] = true
+	}
+
+	prevHealth := make(map[string]*MirrorHealth)
+	if prev != nil {
+		for _, mirror := range prev.Global {
+			if mirror.Health != nil {
+				prevHealth[mirror.URL] = mirror.Health
+			}
+		}
+	}
 
-	// filter mirrors based on completion and protocol
-	for _, mirror := range m.Global {
-		var isHTTP, isComplete bool
+	sort.Stable(sort.Reverse(ByScore(mm.Global)))
 
-		if mirror.Protocol == "http" {
-			httpCount++
-			isHTTP = true
+	// filter mirrors based on completion and the protocol allowlist
+	for _, mirror := range mm.Global {
+		if !allowed[mirror.Protocol] {
+			continue
 		}
 
-		if mirror.Completion >= c.minCompletion {
-			completeCount++
-			isComplete = true
+		threshold := c.minCompletion
+		if t, ok := c.protocolMinCompletion[mirror.Protocol]; ok {
+			threshold = t
+		}
+		if mirror.Completion < threshold {
+			continue
 		}
 
-		if isHTTP && isComplete {
-			newMirrors = append(newMirrors, mirror)
-			country, ok := m.Countries[mirror.CountryCode]
-			if !ok {
-				country = make([]*Mirror, 0)
-			}
-			m.Countries[mirror.CountryCode] = append(country, mirror)
+		if h, ok := prevHealth[mirror.URL]; ok {
+			mirror.Health = h
+		} else {
+			mirror.Health = &MirrorHealth{}
 		}
+		newMirrors = append(newMirrors, mirror)
+	}
+
+	mm.Global = newMirrors
+	mm.FetchedAt = time.Now()
+	mm.Countries, mm.GlobalByProtocol = indexMirrors(mm.Global)
+
+	protocolCounts := make(map[string]int, len(mm.GlobalByProtocol))
+	for proto, list := range mm.GlobalByProtocol {
+		protocolCounts[proto] = len(list)
 	}
 
-	m.Global = newMirrors
+	log.Printf("Mirror stats: Total: %d, Allowed+Complete: %d, per-protocol: %v", totalCount, len(mm.Global), protocolCounts)
 
-	log.Printf("Mirror stats: Total: %d, HTTP: %d, Complete: %d. HTTP and Complete: %d", totalCount, httpCount, completeCount, len(m.Global))
+	return &mm, true, newLastModified, newETag, nil
+}
+
+// indexMirrors builds the Countries and GlobalByProtocol indices used by the
+// selectors from a filtered mirror list, preserving the list's existing
+// ordering within each bucket.
+func indexMirrors(mirrors []*Mirror) (countries map[string]map[string][]*Mirror, byProtocol map[string][]*Mirror) {
+	countries = make(map[string]map[string][]*Mirror)
+	byProtocol = make(map[string][]*Mirror)
+
+	for _, mirror := range mirrors {
+		byProtocol[mirror.Protocol] = append(byProtocol[mirror.Protocol], mirror)
+
+		protoMap, ok := countries[mirror.CountryCode]
+		if !ok {
+			protoMap = make(map[string][]*Mirror)
+			countries[mirror.CountryCode] = protoMap
+		}
+		protoMap[mirror.Protocol] = append(protoMap[mirror.Protocol], mirror)
+	}
 
-	return &m, nil
+	return countries, byProtocol
 }
 
-func redirector(status *atomic.Value, s selector) http.HandlerFunc {
+// redirector wraps a selector as an HTTP handler, redirecting to the chosen
+// mirror. scope labels the response and selector-error metrics this handler
+// observes (e.g. "country", "global:https", "auto") so operators can break
+// down traffic per endpoint; redirects are counted by target country, mirror
+// host and protocol instead.
+func redirector(status *atomic.Value, s selector, scope string, reg *metricsRegistry) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "GET" {
+			reg.httpResponsesTotal.inc(scope, "405")
 			http.Error(w, http.StatusText(405), 405)
 			return
 		}
 
 		c := status.Load().(*MirrorStatus)
 		if len(c.Global) == 0 {
+			reg.httpResponsesTotal.inc(scope, "500")
 			http.Error(w, http.StatusText(500), 500)
 			return
 		}
 		mirror, err := s(c, r)
 		if err != nil {
+			reg.selectorErrorsTotal.inc(scope)
+			reg.httpResponsesTotal.inc(scope, "404")
 			http.Error(w, err.Error(), 404)
 			return
 		}
 
 		url, err := url.Parse(mirror.URL)
 		if err != nil {
+			reg.httpResponsesTotal.inc(scope, "500")
 			http.Error(w, http.StatusText(500), 500)
 			return
 		}
 
 		url.Path = path.Join(url.Path, r.URL.Path)
 
+		reg.redirectsTotal.inc(mirror.CountryCode, url.Host, mirror.Protocol)
+		reg.httpResponsesTotal.inc(scope, "302")
 		http.Redirect(w, r, url.String(), 302)
 	}
 }
 
-func globalSelector(status *MirrorStatus, r *http.Request) (*Mirror, error) {
-	return status.Global[0], nil
+// globalSelector returns a selector that picks a global mirror via lb,
+// preferring protocols earlier in the given preference order and falling
+// back to the next protocol when the preferred one has no healthy mirrors.
+// Mirrors the probe subsystem has evicted are excluded from consideration.
+func globalSelector(protocols []string, lb *loadBalancer) selector {
+	return func(status *MirrorStatus, r *http.Request) (*Mirror, error) {
+		for _, proto := range protocols {
+			if list := filterHealthy(status.GlobalByProtocol[proto]); len(list) > 0 {
+				return lb.pick(list, "global:"+proto)
+			}
+		}
+		return nil, errors.New("no mirrors available for the configured protocols")
+	}
 }
 
-func countrySelector() selector {
+// countrySelector returns a selector that picks a mirror in the requested
+// country via lb, falling back across protocols (in preference order) when
+// the preferred protocol has no healthy mirrors in that country. Mirrors the
+// probe subsystem has evicted are excluded from consideration.
+func countrySelector(protocols []string, lb *loadBalancer) selector {
 	re := regexp.MustCompile(`^/([a-z]{2})(?:/|$)`)
 	return func(status *MirrorStatus, r *http.Request) (*Mirror, error) {
 		res := re.FindStringSubmatch(r.URL.Path)
@@ -226,12 +580,19 @@ func countrySelector() selector {
 			return nil, fmt.Errorf("invalid country code %+v", res)
 		}
 
-		country, ok := status.Countries[strings.ToUpper(res[1])]
+		country := strings.ToUpper(res[1])
+		byProtocol, ok := status.Countries[country]
 		if !ok {
 			return nil, errors.New("country not found")
 		}
 
-		r.URL.Path = r.URL.Path[len(res[0]):]
-		return country[0], nil
+		for _, proto := range protocols {
+			if list := filterHealthy(byProtocol[proto]); len(list) > 0 {
+				r.URL.Path = r.URL.Path[len(res[0]):]
+				return lb.pick(list, "country:"+country+":"+proto)
+			}
+		}
+
+		return nil, errors.New("no mirrors in country for the configured protocols")
 	}
 }
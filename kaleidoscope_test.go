@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffNextNeverExceedsMax(t *testing.T) {
+	max := 5 * time.Minute
+	b := &backoff{max: max}
+
+	for i := 0; i < 50; i++ {
+		if wait := b.next(); wait > max {
+			t.Fatalf("attempt %d: wait %s exceeds max %s", i, wait, max)
+		}
+	}
+}
+
+func TestBackoffNextGrowsExponentially(t *testing.T) {
+	b := &backoff{max: time.Hour}
+
+	prev := time.Duration(0)
+	for i := 0; i < 5; i++ {
+		wait := b.next()
+		// jitter is +/- fetchBackoffJitter, too small to cancel out a
+		// doubling, so every wait must still exceed the previous one.
+		if wait <= prev {
+			t.Fatalf("attempt %d: wait %s did not grow from previous %s", i, wait, prev)
+		}
+		prev = wait
+	}
+}
+
+func TestBackoffNextCapsAtMaxOnceExponentOverflowsMax(t *testing.T) {
+	max := 1 * time.Minute
+	b := &backoff{max: max, attempt: 20}
+
+	if wait := b.next(); wait > max {
+		t.Fatalf("wait %s exceeds max %s once the exponent has overflowed it", wait, max)
+	}
+}
+
+func TestBackoffNextAttemptCounterSaturates(t *testing.T) {
+	b := &backoff{max: time.Hour}
+
+	for i := 0; i < 100; i++ {
+		b.next()
+	}
+	if b.attempt != 30 {
+		t.Errorf("attempt = %d, want 30 (saturated)", b.attempt)
+	}
+}
+
+func TestBackoffReset(t *testing.T) {
+	b := &backoff{max: time.Hour, attempt: 10}
+
+	b.reset()
+	if b.attempt != 0 {
+		t.Errorf("attempt = %d, want 0 after reset", b.attempt)
+	}
+}
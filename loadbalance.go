@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lbConfig configures the load-balancing policy applied across the top-N
+// scoring mirrors for a given selection, so a single slow leader can't
+// monopolize traffic and one dead mirror can't 302-loop every client.
+type lbConfig struct {
+	policy      string
+	topN        int
+	inflightTTL time.Duration
+}
+
+// loadBalancer picks one mirror out of the top-N candidates for a selection
+// according to the configured policy.
+type loadBalancer struct {
+	policy      string
+	topN        int
+	inflightTTL time.Duration
+
+	// roundRobin holds a *atomic.Uint64 counter per selection group (e.g.
+	// "global:https" or "country:US:http"), so each group cycles
+	// independently.
+	roundRobin sync.Map
+}
+
+func newLoadBalancer(c lbConfig) *loadBalancer {
+	return &loadBalancer{
+		policy:      c.policy,
+		topN:        c.topN,
+		inflightTTL: c.inflightTTL,
+	}
+}
+
+// pick chooses a mirror from candidates (assumed sorted best-first) using
+// the configured policy, restricted to the top N. groupKey scopes
+// round-robin state to the selection it was computed for.
+func (lb *loadBalancer) pick(candidates []*Mirror, groupKey string) (*Mirror, error) {
+	if len(candidates) == 0 {
+		return nil, errors.New("no candidate mirrors")
+	}
+
+	top := candidates
+	if lb.topN > 0 && lb.topN < len(candidates) {
+		top = candidates[:lb.topN]
+	}
+
+	var chosen *Mirror
+	switch lb.policy {
+	case "round_robin":
+		chosen = lb.pickRoundRobin(top, groupKey)
+	case "weighted_random":
+		chosen = lb.pickWeightedRandom(top)
+	case "least_inflight":
+		chosen = lb.pickLeastInflight(top)
+	default: // "first"
+		chosen = top[0]
+	}
+
+	// Inflight is only read by least_inflight; don't pay for a timer and
+	// goroutine wakeup per redirect under the other (and default) policies.
+	if lb.policy == "least_inflight" {
+		chosen.Inflight.Add(1)
+		time.AfterFunc(lb.inflightTTL, func() { chosen.Inflight.Add(-1) })
+	}
+
+	return chosen, nil
+}
+
+func (lb *loadBalancer) pickRoundRobin(top []*Mirror, groupKey string) *Mirror {
+	counterVal, _ := lb.roundRobin.LoadOrStore(groupKey, new(atomic.Uint64))
+	counter := counterVal.(*atomic.Uint64)
+	n := counter.Add(1) - 1
+	return top[n%uint64(len(top))]
+}
+
+func (lb *loadBalancer) pickWeightedRandom(top []*Mirror) *Mirror {
+	total := 0.0
+	for _, m := range top {
+		total += mirrorWeight(m)
+	}
+
+	if total <= 0 {
+		return top[rand.Intn(len(top))]
+	}
+
+	target := rand.Float64() * total
+	for _, m := range top {
+		w := mirrorWeight(m)
+		if target < w {
+			return m
+		}
+		target -= w
+	}
+
+	return top[len(top)-1]
+}
+
+func (lb *loadBalancer) pickLeastInflight(top []*Mirror) *Mirror {
+	best := top[0]
+	bestCount := best.Inflight.Load()
+
+	for _, m := range top[1:] {
+		if c := m.Inflight.Load(); c < bestCount {
+			best, bestCount = m, c
+		}
+	}
+
+	return best
+}
+
+func mirrorWeight(m *Mirror) float64 {
+	if m.Score < 0 {
+		return 0
+	}
+	return m.Score
+}
@@ -0,0 +1,134 @@
+package main
+
+import "testing"
+
+func newTestMirrors(scores ...float64) []*Mirror {
+	mirrors := make([]*Mirror, len(scores))
+	for i, s := range scores {
+		mirrors[i] = &Mirror{URL: string(rune('a' + i)), Score: s}
+	}
+	return mirrors
+}
+
+func TestLoadBalancerPickFirst(t *testing.T) {
+	lb := newLoadBalancer(lbConfig{policy: "first", topN: 2})
+	candidates := newTestMirrors(1, 2, 3)
+
+	chosen, err := lb.pick(candidates, "group")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if chosen != candidates[0] {
+		t.Errorf("got %v, want the first candidate", chosen)
+	}
+}
+
+func TestLoadBalancerPickRoundRobin(t *testing.T) {
+	lb := newLoadBalancer(lbConfig{policy: "round_robin", topN: 3})
+	candidates := newTestMirrors(1, 2, 3)
+
+	var got []*Mirror
+	for i := 0; i < 6; i++ {
+		chosen, err := lb.pick(candidates, "group")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		got = append(got, chosen)
+	}
+
+	for i, m := range got {
+		want := candidates[i%len(candidates)]
+		if m != want {
+			t.Errorf("pick %d = %v, want %v", i, m, want)
+		}
+	}
+}
+
+func TestLoadBalancerPickRoundRobinScopedByGroupKey(t *testing.T) {
+	lb := newLoadBalancer(lbConfig{policy: "round_robin", topN: 2})
+	candidates := newTestMirrors(1, 2)
+
+	first, _ := lb.pick(candidates, "group-a")
+	second, _ := lb.pick(candidates, "group-b")
+	if first != second {
+		t.Errorf("expected independent round-robin state per group key, got %v and %v", first, second)
+	}
+}
+
+func TestLoadBalancerPickWeightedRandomSkipsNegativeWeight(t *testing.T) {
+	lb := newLoadBalancer(lbConfig{policy: "weighted_random", topN: 2})
+	candidates := newTestMirrors(-1, 5)
+
+	for i := 0; i < 20; i++ {
+		chosen, err := lb.pick(candidates, "group")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if chosen.Score < 0 {
+			t.Fatalf("picked a mirror with negative weight: %v", chosen)
+		}
+	}
+}
+
+func TestLoadBalancerPickLeastInflight(t *testing.T) {
+	lb := newLoadBalancer(lbConfig{policy: "least_inflight", topN: 3, inflightTTL: fetchBackoffBase})
+	candidates := newTestMirrors(1, 2, 3)
+	candidates[0].Inflight.Add(5)
+	candidates[2].Inflight.Add(1)
+
+	chosen, err := lb.pick(candidates, "group")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if chosen != candidates[1] {
+		t.Errorf("got %v, want the mirror with zero Inflight", chosen)
+	}
+}
+
+func TestLoadBalancerPickOnlyLeastInflightBumpsInflight(t *testing.T) {
+	candidates := newTestMirrors(1, 2, 3)
+
+	for _, policy := range []string{"first", "round_robin", "weighted_random"} {
+		lb := newLoadBalancer(lbConfig{policy: policy, topN: 3})
+		if _, err := lb.pick(candidates, "group"); err != nil {
+			t.Fatalf("policy %s: unexpected error: %s", policy, err)
+		}
+		for _, m := range candidates {
+			if n := m.Inflight.Load(); n != 0 {
+				t.Errorf("policy %s: Inflight = %d, want 0 (only least_inflight should bump it)", policy, n)
+			}
+		}
+	}
+
+	lb := newLoadBalancer(lbConfig{policy: "least_inflight", topN: 3, inflightTTL: fetchBackoffBase})
+	chosen, err := lb.pick(candidates, "group")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if chosen.Inflight.Load() != 1 {
+		t.Errorf("least_inflight: Inflight = %d, want 1", chosen.Inflight.Load())
+	}
+}
+
+func TestLoadBalancerPickRestrictsToTopN(t *testing.T) {
+	lb := newLoadBalancer(lbConfig{policy: "round_robin", topN: 2})
+	candidates := newTestMirrors(1, 2, 3)
+
+	for i := 0; i < 4; i++ {
+		chosen, err := lb.pick(candidates, "group")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if chosen == candidates[2] {
+			t.Errorf("pick %d chose %v, which is outside topN", i, chosen)
+		}
+	}
+}
+
+func TestLoadBalancerPickEmptyCandidates(t *testing.T) {
+	lb := newLoadBalancer(lbConfig{policy: "first", topN: 2})
+
+	if _, err := lb.pick(nil, "group"); err == nil {
+		t.Fatal("expected an error for an empty candidate list, got nil")
+	}
+}
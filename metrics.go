@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metrics is kaleidoscope's process-wide metrics registry, exposed at
+// /metrics in the Prometheus text exposition format. Only the counter and
+// histogram types actually used below are implemented (gauges are written
+// directly by metricsHandler), not the full client library surface.
+var metrics = newMetricsRegistry()
+
+// counterVec is a counter with a fixed set of label names, one value per
+// distinct label-value combination.
+type counterVec struct {
+	name       string
+	help       string
+	labelNames []string
+
+	mu      sync.Mutex
+	entries map[string]*counterEntry
+}
+
+type counterEntry struct {
+	labelValues []string
+	value       atomic.Uint64
+}
+
+func newCounterVec(name, help string, labelNames ...string) *counterVec {
+	return &counterVec{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		entries:    make(map[string]*counterEntry),
+	}
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.entry(labelValues).value.Add(1)
+}
+
+func (c *counterVec) entry(labelValues []string) *counterEntry {
+	key := strings.Join(labelValues, "\x1f")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		e = &counterEntry{labelValues: append([]string(nil), labelValues...)}
+		c.entries[key] = e
+	}
+	return e
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, key := range sortedKeys(c.entries) {
+		e := c.entries[key]
+		fmt.Fprintf(w, "%s%s %d\n", c.name, formatLabels(c.labelNames, e.labelValues), e.value.Load())
+	}
+}
+
+// histogramVec is a histogram with a fixed set of label names and buckets,
+// one set of bucket counters per distinct label-value combination.
+type histogramVec struct {
+	name       string
+	help       string
+	labelNames []string
+	buckets    []float64
+
+	mu      sync.Mutex
+	entries map[string]*histogramEntry
+}
+
+type histogramEntry struct {
+	mu           sync.Mutex
+	labelValues  []string
+	bucketCounts []uint64
+	sum          float64
+	count        uint64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labelNames ...string) *histogramVec {
+	return &histogramVec{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		buckets:    buckets,
+		entries:    make(map[string]*histogramEntry),
+	}
+}
+
+func (h *histogramVec) observe(labelValues []string, v float64) {
+	key := strings.Join(labelValues, "\x1f")
+
+	h.mu.Lock()
+	e, ok := h.entries[key]
+	if !ok {
+		e = &histogramEntry{
+			labelValues:  append([]string(nil), labelValues...),
+			bucketCounts: make([]uint64, len(h.buckets)),
+		}
+		h.entries[key] = e
+	}
+	h.mu.Unlock()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for i, b := range h.buckets {
+		if v <= b {
+			e.bucketCounts[i]++
+		}
+	}
+	e.sum += v
+	e.count++
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	h.mu.Lock()
+	keys := sortedKeys(h.entries)
+	h.mu.Unlock()
+
+	for _, key := range keys {
+		e := h.entries[key]
+
+		e.mu.Lock()
+		bucketNames := append(append([]string(nil), h.labelNames...), "le")
+		for i, b := range h.buckets {
+			values := append(append([]string(nil), e.labelValues...), formatFloat(b))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(bucketNames, values), e.bucketCounts[i])
+		}
+		infValues := append(append([]string(nil), e.labelValues...), "+Inf")
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(bucketNames, infValues), e.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labelNames, e.labelValues), formatFloat(e.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labelNames, e.labelValues), e.count)
+		e.mu.Unlock()
+	}
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	parts := make([]string, len(names))
+	for i, n := range names {
+		parts[i] = fmt.Sprintf("%s=%q", n, values[i])
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strings.TrimRight(strings.TrimRight(fmt.Sprintf("%f", v), "0"), ".")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// probeLatencyBuckets covers typical mirror response times, from a fast
+// same-region hit to a slow or timing-out transfer.
+var probeLatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 5, 10}
+
+// fetchDurationBuckets covers typical durations of the upstream mirror list
+// fetch/decode.
+var fetchDurationBuckets = []float64{0.1, 0.25, 0.5, 1, 2, 5, 10, 30}
+
+// metricsRegistry holds every metric kaleidoscope exposes on /metrics.
+type metricsRegistry struct {
+	redirectsTotal       *counterVec
+	selectorErrorsTotal  *counterVec
+	httpResponsesTotal   *counterVec
+	fetchFailuresTotal   *counterVec
+	fetchDurationSeconds *histogramVec
+	probeLatencySeconds  *histogramVec
+
+	mu          sync.Mutex
+	lastSuccess time.Time
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		redirectsTotal:       newCounterVec("kaleidoscope_redirects_total", "Total redirects served, by target country, mirror host and protocol.", "country", "mirror", "protocol"),
+		selectorErrorsTotal:  newCounterVec("kaleidoscope_selector_errors_total", "Total selector errors, by endpoint scope.", "scope"),
+		httpResponsesTotal:   newCounterVec("kaleidoscope_http_responses_total", "Total HTTP responses served, by endpoint scope and status code.", "scope", "status"),
+		fetchFailuresTotal:   newCounterVec("kaleidoscope_fetch_failures_total", "Total upstream mirror list fetch failures, by error type.", "error_type"),
+		fetchDurationSeconds: newHistogramVec("kaleidoscope_fetch_duration_seconds", "Duration of upstream mirror list fetch and decode.", fetchDurationBuckets),
+		probeLatencySeconds:  newHistogramVec("kaleidoscope_probe_latency_seconds", "Latency of active mirror health probes, by mirror host.", probeLatencyBuckets, "mirror"),
+	}
+}
+
+func (m *metricsRegistry) recordFetchSuccess(d time.Duration) {
+	m.mu.Lock()
+	m.lastSuccess = time.Now()
+	m.mu.Unlock()
+	m.fetchDurationSeconds.observe(nil, d.Seconds())
+}
+
+func (m *metricsRegistry) recordFetchFailure(d time.Duration, errType string) {
+	m.fetchFailuresTotal.inc(errType)
+	m.fetchDurationSeconds.observe(nil, d.Seconds())
+}
+
+func (m *metricsRegistry) secondsSinceLastSuccess() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.lastSuccess.IsZero() {
+		return -1
+	}
+	return time.Since(m.lastSuccess).Seconds()
+}
+
+// metricsHandler renders the registry plus a handful of point-in-time
+// gauges derived from the current MirrorStatus, in the Prometheus text
+// exposition format.
+func metricsHandler(status *atomic.Value, reg *metricsRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		reg.redirectsTotal.writeTo(w)
+		reg.selectorErrorsTotal.writeTo(w)
+		reg.httpResponsesTotal.writeTo(w)
+		reg.fetchFailuresTotal.writeTo(w)
+		reg.fetchDurationSeconds.writeTo(w)
+		reg.probeLatencySeconds.writeTo(w)
+
+		fmt.Fprintf(w, "# HELP kaleidoscope_seconds_since_last_successful_update Seconds since the last successful mirror list update.\n")
+		fmt.Fprintf(w, "# TYPE kaleidoscope_seconds_since_last_successful_update gauge\n")
+		fmt.Fprintf(w, "kaleidoscope_seconds_since_last_successful_update %s\n", formatFloat(reg.secondsSinceLastSuccess()))
+
+		c, ok := status.Load().(*MirrorStatus)
+		if !ok || c == nil {
+			return
+		}
+
+		fmt.Fprintf(w, "# HELP kaleidoscope_mirrors Number of mirrors available after filtering, by protocol.\n")
+		fmt.Fprintf(w, "# TYPE kaleidoscope_mirrors gauge\n")
+		for _, proto := range sortedKeys(c.GlobalByProtocol) {
+			fmt.Fprintf(w, "kaleidoscope_mirrors{protocol=%q} %d\n", proto, len(c.GlobalByProtocol[proto]))
+		}
+
+		fmt.Fprintf(w, "# HELP kaleidoscope_country_mirrors Number of mirrors available after filtering, by country and protocol.\n")
+		fmt.Fprintf(w, "# TYPE kaleidoscope_country_mirrors gauge\n")
+		for _, country := range sortedKeys(c.Countries) {
+			byProtocol := c.Countries[country]
+			for _, proto := range sortedKeys(byProtocol) {
+				fmt.Fprintf(w, "kaleidoscope_country_mirrors{country=%q,protocol=%q} %d\n", country, proto, len(byProtocol[proto]))
+			}
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// probeHealthAlpha is the smoothing factor used for the EWMA of probe
+// latency and throughput. Higher values weight recent samples more heavily.
+const probeHealthAlpha = 0.3
+
+// probeConfig controls the active health-probing subsystem.
+type probeConfig struct {
+	enabled     bool
+	interval    time.Duration
+	timeout     time.Duration
+	concurrency int
+	path        string
+	maxFailures int
+}
+
+// MirrorHealth holds rolling health metrics gathered by active probes for a
+// single mirror. The zero value is valid and represents a mirror with no
+// probe history yet. It is safe for concurrent use.
+type MirrorHealth struct {
+	mu sync.RWMutex
+
+	latencyEWMA         time.Duration
+	throughputEWMA      float64 // bytes per millisecond
+	consecutiveFailures int
+	evicted             bool
+	lastProbe           time.Time
+}
+
+// snapshot returns a consistent copy of the current health metrics.
+func (h *MirrorHealth) snapshot() (latency time.Duration, throughput float64, failures int, evicted bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.latencyEWMA, h.throughputEWMA, h.consecutiveFailures, h.evicted
+}
+
+// recordSuccess folds a new latency/throughput sample into the EWMA and
+// resets the consecutive failure counter.
+func (h *MirrorHealth) recordSuccess(latency time.Duration, bytes int64) {
+	throughput := float64(bytes) / float64(latency.Milliseconds()+1)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.lastProbe.IsZero() {
+		h.latencyEWMA = latency
+		h.throughputEWMA = throughput
+	} else {
+		h.latencyEWMA = time.Duration(probeHealthAlpha*float64(latency) + (1-probeHealthAlpha)*float64(h.latencyEWMA))
+		h.throughputEWMA = probeHealthAlpha*throughput + (1-probeHealthAlpha)*h.throughputEWMA
+	}
+
+	h.consecutiveFailures = 0
+	h.lastProbe = time.Now()
+}
+
+// recordFailure marks a failed probe, evicting the mirror once maxFailures
+// consecutive failures have been observed.
+func (h *MirrorHealth) recordFailure(maxFailures int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.consecutiveFailures++
+	h.lastProbe = time.Now()
+	if h.consecutiveFailures >= maxFailures {
+		h.evicted = true
+	}
+}
+
+// runProbes periodically probes every mirror in the current MirrorStatus for
+// latency and throughput, updating each mirror's Health in place. It blocks
+// until ctx is cancelled and is a no-op when probing is disabled.
+func runProbes(ctx context.Context, status *atomic.Value, pc probeConfig) {
+	if !pc.enabled {
+		return
+	}
+
+	log.Printf("Probe subsystem started (interval %s, concurrency %d).", pc.interval, pc.concurrency)
+	ticker := time.NewTicker(pc.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			probeAll(status, pc)
+		}
+	}
+}
+
+// probeAll probes every mirror currently loaded in status, bounding
+// concurrency to pc.concurrency.
+func probeAll(status *atomic.Value, pc probeConfig) {
+	c, ok := status.Load().(*MirrorStatus)
+	if !ok || c == nil {
+		return
+	}
+
+	sem := make(chan struct{}, pc.concurrency)
+	var wg sync.WaitGroup
+
+	for _, mirror := range c.Global {
+		if mirror.Health == nil {
+			mirror.Health = &MirrorHealth{}
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(m *Mirror) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			probeOne(m, pc)
+		}(mirror)
+	}
+
+	wg.Wait()
+}
+
+// probeOne issues a single GET against pc.path on mirror m and records the
+// observed latency and throughput, or a failure if the probe errors out or
+// returns a non-2xx/3xx status.
+func probeOne(m *Mirror, pc probeConfig) {
+	client := http.Client{Timeout: pc.timeout}
+
+	target := strings.TrimRight(m.URL, "/") + "/" + strings.TrimLeft(pc.path, "/")
+
+	start := time.Now()
+	resp, err := client.Get(target)
+	if err != nil {
+		m.Health.recordFailure(pc.maxFailures)
+		return
+	}
+	defer resp.Body.Close()
+
+	n, err := io.Copy(io.Discard, resp.Body)
+	latency := time.Since(start)
+	if err != nil || resp.StatusCode >= 400 {
+		m.Health.recordFailure(pc.maxFailures)
+		return
+	}
+
+	m.Health.recordSuccess(latency, n)
+	metrics.probeLatencySeconds.observe([]string{mirrorHost(m)}, latency.Seconds())
+}
+
+// mirrorHost extracts the host[:port] component of a mirror's URL for use
+// as a low-cardinality metric label.
+func mirrorHost(m *Mirror) string {
+	if u, err := url.Parse(m.URL); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return m.URL
+}
+
+// healthy reports whether the probe subsystem has not evicted m after too
+// many consecutive failed probes. A mirror with no probe history yet (or
+// when probing is disabled) is always considered healthy.
+func (m *Mirror) healthy() bool {
+	if m.Health == nil {
+		return true
+	}
+	_, _, _, evicted := m.Health.snapshot()
+	return !evicted
+}
+
+// filterHealthy returns the subset of mirrors the probe subsystem hasn't
+// evicted, preserving order, so lb.pick never hands out a mirror that's
+// failed probe-max-failures consecutive health checks.
+func filterHealthy(mirrors []*Mirror) []*Mirror {
+	healthy := make([]*Mirror, 0, len(mirrors))
+	for _, m := range mirrors {
+		if m.healthy() {
+			healthy = append(healthy, m)
+		}
+	}
+	return healthy
+}
+
+// healthScore computes a weighted ranking score for a mirror combining
+// measured latency, throughput, upstream score and recent failures. Higher
+// is better; evicted mirrors score below any viable mirror.
+func healthScore(m *Mirror) float64 {
+	if m.Health == nil {
+		return m.Score
+	}
+
+	latency, throughput, failures, evicted := m.Health.snapshot()
+	if evicted {
+		return math.Inf(-1)
+	}
+
+	const (
+		wScore      = 0.4
+		wLatency    = 0.3
+		wThroughput = 0.3
+	)
+
+	latencyScore := 1.0
+	if latency > 0 {
+		latencyScore = 1.0 / (1.0 + latency.Seconds())
+	}
+
+	score := wScore*m.Score + wLatency*latencyScore + wThroughput*throughput
+	score -= float64(failures) * 0.05
+
+	return score
+}
+
+// probeWeightedSelector ranks the global mirror list by healthScore rather
+// than the raw upstream Score, preferring mirrors with low measured latency
+// and high throughput over the unconditional top-score pick.
+func probeWeightedSelector(status *MirrorStatus, r *http.Request) (*Mirror, error) {
+	var best *Mirror
+	bestScore := math.Inf(-1)
+
+	for _, m := range status.Global {
+		if s := healthScore(m); s > bestScore {
+			best, bestScore = m, s
+		}
+	}
+
+	if best == nil {
+		return nil, errors.New("no healthy mirrors available")
+	}
+
+	return best, nil
+}
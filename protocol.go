@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// parseProtocolList splits a comma-separated protocol preference list such
+// as "https,http,rsync" into its ordered components, ignoring blank entries
+// and collapsing duplicates (keeping the first occurrence's position) so a
+// repeated entry can't cause the per-protocol routes to be mounted twice.
+func parseProtocolList(s string) []string {
+	var protocols []string
+	seen := make(map[string]bool)
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" || seen[p] {
+			continue
+		}
+		seen[p] = true
+		protocols = append(protocols, p)
+	}
+	return protocols
+}
+
+// parseProtocolCompletion parses a comma-separated list of per-protocol
+// completion overrides such as "rsync=0.95,http=1.0" into a map. Malformed
+// entries are ignored.
+func parseProtocolCompletion(s string) map[string]float64 {
+	overrides := make(map[string]float64)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		proto, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+
+		threshold, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			continue
+		}
+
+		overrides[strings.TrimSpace(proto)] = threshold
+	}
+	return overrides
+}
+
+// parseTrustedProxies parses a comma-separated CIDR list such as
+// "10.0.0.0/8,192.168.1.1/32" into the network set trusted to set
+// X-Forwarded-For/X-Real-IP. Malformed entries are logged and skipped.
+func parseTrustedProxies(s string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range strings.Split(s, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Printf("Ignoring invalid -trust-proxy entry %q: %s", cidr, err)
+			continue
+		}
+
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// statusView is the JSON shape returned by the /status endpoint.
+type statusView struct {
+	LastCheck       string         `json:"last_check"`
+	FetchedAt       string         `json:"fetched_at"`
+	AgeSeconds      float64        `json:"age_seconds"`
+	Stale           bool           `json:"stale"`
+	TotalMirrors    int            `json:"total_mirrors"`
+	CountriesServed int            `json:"countries_served"`
+	ProtocolCounts  map[string]int `json:"protocol_counts"`
+}
+
+// statusHandler serves the current MirrorStatus, filtered down to the
+// counts operators care about, as JSON. Unlike the redirecting endpoints,
+// it always responds (even when data is stale) so operators can diagnose
+// degraded state instead of just seeing 503s.
+func statusHandler(status *atomic.Value, maxStale time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, ok := status.Load().(*MirrorStatus)
+		if !ok || c == nil {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+
+		counts := make(map[string]int, len(c.GlobalByProtocol))
+		for proto, mirrors := range c.GlobalByProtocol {
+			counts[proto] = len(mirrors)
+		}
+
+		age := time.Since(c.FetchedAt)
+
+		view := statusView{
+			LastCheck:       c.LastCheck.Format("2006-01-02T15:04:05Z07:00"),
+			FetchedAt:       c.FetchedAt.Format("2006-01-02T15:04:05Z07:00"),
+			AgeSeconds:      age.Seconds(),
+			Stale:           maxStale > 0 && age > maxStale,
+			TotalMirrors:    len(c.Global),
+			CountriesServed: len(c.Countries),
+			ProtocolCounts:  counts,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(view)
+	}
+}